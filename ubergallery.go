@@ -1,18 +1,35 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net/http"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"bitbucket.org/huperwebs/webutils/templates"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-ini/ini"
 	"github.com/julienschmidt/httprouter"
 	"github.com/nfnt/resize"
 	"image"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -21,15 +38,40 @@ const (
 	ConfigFilename   = "galleryConfig.ini"
 	GalleryDirectory = "gallery-images"
 	ViewDirectory    = "view"
+	CacheDirectory   = "cache"
+
+	DefaultThumbnailPreset = "default"
+
+	// DefaultThemeName is used when the config file doesn't set theme_name,
+	// so the gallery renders out of the box instead of failing to find a
+	// "".html view.
+	DefaultThemeName = "default"
+
+	// cacheHashLength is how many hex characters of a source file's SHA-256
+	// are kept in its cache filename - enough to make collisions a non-issue.
+	cacheHashLength = 16
 
 	Port = 8080
 )
 
+// cacheFilenamePattern matches thumbnails generated by GenerateThumbnail, of
+// the form "<preset>-<original filename>-<hash>-<w>x<h>.<ext>".
+var cacheFilenamePattern = regexp.MustCompile(`^([^-]+)-(.+)-([0-9a-f]{16})-\d+x\d+\.\w+$`)
+
 var (
 	router = httprouter.New()
-	config *Config
+
+	// configValue holds the active *Config. It's swapped atomically on
+	// SIGHUP so in-flight requests keep running against a consistent
+	// config instead of observing a partially-applied reload.
+	configValue atomic.Value
 )
 
+// CurrentConfig returns the currently active config.
+func CurrentConfig() *Config {
+	return configValue.Load().(*Config)
+}
+
 type Config struct {
 	CacheExpiration int
 
@@ -42,10 +84,94 @@ type Config struct {
 	ThumbnailQuality int
 	ThemeName        string
 
+	Thumbnails         map[string]ThumbnailPreset
+	AnimatedThumbnails bool
+
 	ImageSortBy string
 	ReverseSort bool
 
 	EnableDebugging bool
+
+	WatchGallery     bool
+	ThumbnailWorkers int
+}
+
+// ThumbnailPreset describes one named thumbnail variant: its target size,
+// whether it should be cropped to fill that size or fit within it, and the
+// scaling algorithm used to produce it.
+type ThumbnailPreset struct {
+	Width     uint
+	Height    uint
+	Crop      bool
+	Algorithm resize.InterpolationFunction
+}
+
+// defaultThumbnailPresets returns the built-in imgur-style presets used when
+// the config file doesn't define (or override) them under [thumbnails].
+func defaultThumbnailPresets() map[string]ThumbnailPreset {
+	return map[string]ThumbnailPreset{
+		"s": {Width: 90, Height: 90, Crop: true, Algorithm: resize.Lanczos3},
+		"m": {Width: 160, Height: 160, Crop: true, Algorithm: resize.Lanczos3},
+		"l": {Width: 320, Height: 320, Crop: false, Algorithm: resize.Lanczos3},
+		"h": {Width: 640, Height: 640, Crop: false, Algorithm: resize.Lanczos3},
+	}
+}
+
+// parseThumbnailPreset parses a `[thumbnails]` ini value of the form
+// "WxH,crop|fit,algorithm", e.g. "90x90,crop,lanczos".
+func parseThumbnailPreset(value string) (ThumbnailPreset, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return ThumbnailPreset{}, fmt.Errorf("expected 'WxH,crop|fit,algorithm', got %q", value)
+	}
+
+	dims := strings.Split(parts[0], "x")
+	if len(dims) != 2 {
+		return ThumbnailPreset{}, fmt.Errorf("invalid dimensions %q", parts[0])
+	}
+	width, err := strconv.Atoi(dims[0])
+	if err != nil {
+		return ThumbnailPreset{}, fmt.Errorf("invalid width %q", dims[0])
+	}
+	height, err := strconv.Atoi(dims[1])
+	if err != nil {
+		return ThumbnailPreset{}, fmt.Errorf("invalid height %q", dims[1])
+	}
+
+	var crop bool
+	switch parts[1] {
+	case "crop":
+		crop = true
+	case "fit":
+		crop = false
+	default:
+		return ThumbnailPreset{}, fmt.Errorf("unknown mode %q, expected 'crop' or 'fit'", parts[1])
+	}
+
+	algorithm, err := parseThumbnailAlgorithm(parts[2])
+	if err != nil {
+		return ThumbnailPreset{}, err
+	}
+
+	return ThumbnailPreset{
+		Width:     uint(width),
+		Height:    uint(height),
+		Crop:      crop,
+		Algorithm: algorithm,
+	}, nil
+}
+
+func parseThumbnailAlgorithm(name string) (resize.InterpolationFunction, error) {
+	switch name {
+	case "lanczos":
+		return resize.Lanczos3, nil
+	case "bilinear":
+		return resize.Bilinear, nil
+	case "nearestneighbor":
+		return resize.NearestNeighbor, nil
+	default:
+		return 0, fmt.Errorf("unknown algorithm %q", name)
+	}
 }
 
 func ReadConfig(filename string) (*Config, error) {
@@ -59,7 +185,9 @@ func ReadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	config := &Config{}
+	// AnimatedThumbnails defaults to true; GIFs stay animated out of the box,
+	// with `animated_thumbnails = false` as the opt-out for very large GIFs.
+	config := &Config{AnimatedThumbnails: true}
 
 	for _, section := range cfg.Sections() {
 		switch section.Name() {
@@ -73,7 +201,7 @@ func ReadConfig(filename string) (*Config, error) {
 					if err != nil {
 						log.Println("Error: 'cache_expiration' unable to parse integer:", err)
 					}
-					config.PaginatorThreshold = i
+					config.CacheExpiration = i
 				case "enable_pagination":
 					config.EnablePagination = (key.Value() == "true")
 				case "paginator_threshold":
@@ -124,120 +252,1063 @@ func ReadConfig(filename string) (*Config, error) {
 					}
 					config.ImagesPerPage = i
 				case "images_sort_by":
+					config.ImageSortBy = key.Value()
 				case "reverse_sort":
 					config.ReverseSort = (key.Value() == "true")
+				case "animated_thumbnails":
+					config.AnimatedThumbnails = (key.Value() != "false")
 				case "enable_debugging":
 					config.EnableDebugging = (key.Value() == "true")
+				case "watch_gallery":
+					config.WatchGallery = (key.Value() == "true")
+				case "thumbnail_workers":
+					i, err := strconv.Atoi(key.Value())
+					if err != nil {
+						log.Println("Error: 'thumbnail_workers' unable to parse integer:", err)
+					}
+					config.ThumbnailWorkers = i
 				default:
 					log.Println("Warning: unsupported key:", key.Name())
 				}
 			}
+		case "thumbnails":
+			for _, key := range section.Keys() {
+				preset, err := parseThumbnailPreset(key.Value())
+				if err != nil {
+					log.Println("Error: 'thumbnails' invalid preset", key.Name()+":", err)
+					continue
+				}
+				if config.Thumbnails == nil {
+					config.Thumbnails = map[string]ThumbnailPreset{}
+				}
+				config.Thumbnails[key.Name()] = preset
+			}
 		default:
 			log.Println("Warning: unsupported section:", section.Name())
 		}
 	}
 
+	// Merge user-defined presets on top of the built-in ones, then add the
+	// classic single-size thumbnail as the "default" preset.
+	presets := defaultThumbnailPresets()
+	for name, preset := range config.Thumbnails {
+		presets[name] = preset
+	}
+	presets[DefaultThumbnailPreset] = ThumbnailPreset{
+		Width:     config.ThumbnailWidth,
+		Height:    config.ThumbnailHeight,
+		Crop:      false,
+		Algorithm: resize.Lanczos3,
+	}
+	config.Thumbnails = presets
+
+	if config.ThemeName == "" {
+		config.ThemeName = DefaultThemeName
+	}
+
 	return config, nil
 }
 
 type Image struct {
-	Name      string
-	Thumbnail string
-	URL       string
+	Name       string            `json:"name"`
+	Format     string            `json:"format"` // detected MIME type of the source file, e.g. "image/gif"
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	ModTime    time.Time         `json:"mtime"`
+	Size       int64             `json:"size"`
+	Thumbnails map[string]string `json:"thumbnails"`
+	URL        string            `json:"url"`
 }
 
-func DefaultRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var images []Image
+// GalleryInfo describes the current page of a paginated gallery, so themes
+// can render page links without knowing the pagination rules themselves.
+type GalleryInfo struct {
+	Index    int // current page, 1-based
+	IndexMax int // last page, 1-based
+	Pages    int // total number of pages
+	Total    int // total number of images across all pages
+}
+
+// loadImages builds the (unsorted, unpaginated) metadata for every image in
+// the gallery. When the gallery watcher is running it's served straight out
+// of the in-memory index; otherwise it falls back to scanning the directory.
+func loadImages() ([]Image, error) {
+	if entries := currentGalleryIndex(); entries != nil {
+		images := make([]Image, len(entries))
+		for i, entry := range entries {
+			images[i] = entry.Image()
+		}
+		return images, nil
+	}
+
+	return loadImagesFromDisk()
+}
 
-	// Load images
+// loadImagesFromDisk reads the gallery directory and builds the metadata for
+// every image in it, stat-ing and decoding each one on the spot.
+func loadImagesFromDisk() ([]Image, error) {
 	files, err := ioutil.ReadDir(filepath.Join("public", GalleryDirectory))
+	if err != nil {
+		return nil, err
+	}
+
+	var images []Image
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		images = append(images, buildGalleryEntry(file.Name(), file).Image())
+	}
+	return images, nil
+}
+
+// decodeDimensions reads just enough of the file at path to determine its
+// pixel dimensions, without decoding the whole image.
+func decodeDimensions(path string) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// GalleryEntry is the in-memory index record for one gallery image: just
+// enough to build an Image without touching the filesystem again.
+type GalleryEntry struct {
+	Name    string
+	Format  string
+	Width   int
+	Height  int
+	ModTime time.Time
+	Size    int64
+}
+
+// Image converts an indexed entry into the shape templates and the JSON API
+// expect, building its thumbnail URLs on demand.
+func (e GalleryEntry) Image() Image {
+	return Image{
+		Name:       e.Name,
+		Format:     e.Format,
+		Width:      e.Width,
+		Height:     e.Height,
+		ModTime:    e.ModTime,
+		Size:       e.Size,
+		Thumbnails: ThumbnailURLs(e.Name),
+		URL:        "/" + filepath.Join("public", GalleryDirectory, e.Name),
+	}
+}
+
+// buildGalleryEntry stats and inspects a single gallery file to produce its
+// index entry.
+func buildGalleryEntry(name string, info os.FileInfo) GalleryEntry {
+	path := filepath.Join("public", GalleryDirectory, name)
+
+	format, err := DetectFormat(path)
+	if err != nil {
+		log.Println("Warning: could not detect format of", name, err)
+	}
+	width, height, err := decodeDimensions(path)
+	if err != nil {
+		log.Println("Warning: could not decode dimensions of", name, err)
+	}
+
+	return GalleryEntry{
+		Name:    name,
+		Format:  format,
+		Width:   width,
+		Height:  height,
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+	}
+}
+
+type entriesByName []GalleryEntry
+
+func (s entriesByName) Len() int           { return len(s) }
+func (s entriesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s entriesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// galleryIndex holds the current []GalleryEntry while the gallery watcher is
+// running, kept sorted by name. nil when the watcher isn't enabled, in which
+// case loadImages falls back to scanning the directory per request.
+var galleryIndex atomic.Value
+
+func currentGalleryIndex() []GalleryEntry {
+	v := galleryIndex.Load()
+	if v == nil {
+		return nil
+	}
+	return v.([]GalleryEntry)
+}
+
+// GalleryWatcher keeps galleryIndex in sync with public/gallery-images via
+// fsnotify, and warms the thumbnail cache for newly added files using a
+// bounded pool of workers.
+type GalleryWatcher struct {
+	watcher *fsnotify.Watcher
+	workers chan struct{}
+
+	// indexMu serializes upsertEntry/removeEntry's read-modify-write of
+	// galleryIndex. Worker goroutines run concurrently, so without this two
+	// events landing close together (e.g. the CREATE+WRITE pair fsnotify
+	// emits for one upload) could both read the same snapshot and then
+	// Store their own version, silently dropping one entry.
+	indexMu sync.Mutex
+}
+
+// StartGalleryWatcher scans the gallery directory to build the initial
+// index, then starts watching it for changes. workerCount bounds how many
+// files are thumbnailed concurrently; values below 1 are treated as 1.
+func StartGalleryWatcher(workerCount int) (*GalleryWatcher, error) {
+	dir := filepath.Join("public", GalleryDirectory)
+
+	entries, err := scanGalleryDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	galleryIndex.Store(entries)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	gw := &GalleryWatcher{watcher: watcher, workers: make(chan struct{}, workerCount)}
+	go gw.run()
+	return gw, nil
+}
+
+func scanGalleryDirectory(dir string) ([]GalleryEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]GalleryEntry, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		entries = append(entries, buildGalleryEntry(file.Name(), file))
+	}
+	sort.Sort(entriesByName(entries))
+	return entries, nil
+}
+
+func (gw *GalleryWatcher) run() {
+	for {
+		select {
+		case event, ok := <-gw.watcher.Events:
+			if !ok {
+				return
+			}
+			gw.handleEvent(event)
+		case err, ok := <-gw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Warning: gallery watcher error:", err)
+		}
+	}
+}
+
+func (gw *GalleryWatcher) handleEvent(event fsnotify.Event) {
+	name := filepath.Base(event.Name)
+
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		gw.removeEntry(name)
+		return
+	}
+
+	if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
+		gw.workers <- struct{}{}
+		go func() {
+			defer func() { <-gw.workers }()
+			gw.indexAndThumbnail(name)
+		}()
+	}
+}
+
+// indexAndThumbnail re-indexes a single gallery file and pre-generates its
+// thumbnails for every configured preset, so the first page load after an
+// upload doesn't have to generate them on demand.
+func (gw *GalleryWatcher) indexAndThumbnail(name string) {
+	path := filepath.Join("public", GalleryDirectory, name)
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	gw.upsertEntry(buildGalleryEntry(name, info))
+
+	for preset := range CurrentConfig().Thumbnails {
+		GenerateThumbnail(name, preset)
+	}
+}
+
+func (gw *GalleryWatcher) upsertEntry(entry GalleryEntry) {
+	gw.indexMu.Lock()
+	defer gw.indexMu.Unlock()
+
+	existing := currentGalleryIndex()
+	updated := make([]GalleryEntry, 0, len(existing)+1)
+	replaced := false
+	for _, e := range existing {
+		if e.Name == entry.Name {
+			updated = append(updated, entry)
+			replaced = true
+			continue
+		}
+		updated = append(updated, e)
+	}
+	if !replaced {
+		updated = append(updated, entry)
+	}
+	sort.Sort(entriesByName(updated))
+	galleryIndex.Store(updated)
+}
+
+func (gw *GalleryWatcher) removeEntry(name string) {
+	gw.indexMu.Lock()
+	defer gw.indexMu.Unlock()
+
+	existing := currentGalleryIndex()
+	updated := make([]GalleryEntry, 0, len(existing))
+	for _, e := range existing {
+		if e.Name != name {
+			updated = append(updated, e)
+		}
+	}
+	galleryIndex.Store(updated)
+}
+
+func DefaultRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	images, err := loadImages()
 	if err != nil {
 		templates.WriteInternalError(w, err.Error())
 		return
 	}
 
-	for _, file := range files {
-		if !file.IsDir() {
-			// Generate thumbnail if needed
+	sortImages(images, CurrentConfig().ImageSortBy, CurrentConfig().ReverseSort)
+
+	images, info := paginateImages(images, r)
+
+	data := struct {
+		Images  []Image
+		Gallery GalleryInfo
+	}{images, info}
+
+	p := templates.NewPage("images", data)
+	templates.Execute(w, r, CurrentConfig().ThemeName+".html", p)
+}
+
+// ImagesAPIRoute serves the paginated gallery as JSON, honoring the same
+// sort/pagination config and query parameters as DefaultRoute.
+func ImagesAPIRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	images, err := loadImages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sortImages(images, CurrentConfig().ImageSortBy, CurrentConfig().ReverseSort)
+	images, info := paginateImages(images, r)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Images  []Image     `json:"images"`
+		Gallery GalleryInfo `json:"gallery"`
+	}{images, info})
+}
+
+// ImageAPIRoute serves a single image's metadata as JSON.
+func ImageAPIRoute(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	name := params.ByName("name")
 
-			images = append(images, Image{
-				Name:      file.Name(),
-				Thumbnail: GenerateThumbnail(file.Name()),
-				URL:       "/" + filepath.Join("public", GalleryDirectory, file.Name()),
-			})
+	images, err := loadImages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, img := range images {
+		if img.Name == name {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(img)
+			return
 		}
 	}
+	http.NotFound(w, r)
+}
+
+type imagesByName []Image
 
-	p := templates.NewPage("images", images)
-	templates.Execute(w, r, config.ThemeName+".html", p)
+func (s imagesByName) Len() int           { return len(s) }
+func (s imagesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s imagesByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+type imagesByModTime []Image
+
+func (s imagesByModTime) Len() int           { return len(s) }
+func (s imagesByModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s imagesByModTime) Less(i, j int) bool { return s[i].ModTime.Before(s[j].ModTime) }
+
+type imagesBySize []Image
+
+func (s imagesBySize) Len() int           { return len(s) }
+func (s imagesBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s imagesBySize) Less(i, j int) bool { return s[i].Size < s[j].Size }
+
+// sortImages sorts images in place by the named field ("name", "mtime" or
+// "size"; anything else falls back to "name"), or shuffles them when by is
+// "random". reverse is ignored for "random".
+func sortImages(images []Image, by string, reverse bool) {
+	if by == "random" {
+		rand.Shuffle(len(images), func(i, j int) { images[i], images[j] = images[j], images[i] })
+		return
+	}
+
+	var s sort.Interface
+	switch by {
+	case "mtime":
+		s = imagesByModTime(images)
+	case "size":
+		s = imagesBySize(images)
+	default:
+		s = imagesByName(images)
+	}
+
+	if reverse {
+		s = sort.Reverse(s)
+	}
+	sort.Sort(s)
 }
 
-func GenerateThumbnail(filename string) string {
-	thumbName := fmt.Sprintf("%s/%dx%d-%s",
-		filepath.Join("public", "cache"),
-		config.ThumbnailWidth,
-		config.ThumbnailHeight,
-		filename,
-	)
+// paginateImages slices images into the page requested via the `page` or
+// `offset` query parameters (offset, if given, wins) and returns the info
+// themes need to render page links. Pagination is skipped entirely - the
+// full set is returned - unless EnablePagination is set, ImagesPerPage is
+// positive and there are more images than PaginatorThreshold.
+func paginateImages(images []Image, r *http.Request) ([]Image, GalleryInfo) {
+	total := len(images)
 
-	// Generate it if needed
-	if _, err := os.Stat(thumbName); os.IsNotExist(err) {
-		file, err := os.Open(filepath.Join("public", GalleryDirectory, filename))
-		if err != nil {
-			log.Println("Warning: could not create thumbnail for", filename, err)
-			return filepath.Join("public", GalleryDirectory, filename)
+	perPage := CurrentConfig().ImagesPerPage
+	pages := 1
+	if perPage > 0 {
+		pages = (total + perPage - 1) / perPage
+		if pages < 1 {
+			pages = 1
 		}
+	}
+
+	if !CurrentConfig().EnablePagination || total <= CurrentConfig().PaginatorThreshold || perPage <= 0 {
+		return images, GalleryInfo{Index: 1, IndexMax: 1, Pages: 1, Total: total}
+	}
 
-		// Load original file
-		img, _, err := image.Decode(file)
+	page := 1
+	if v, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && v > 0 {
+		page = v
+	}
+	if page > pages {
+		page = pages
+	}
+	offset := (page - 1) * perPage
+	if v, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && v >= 0 {
+		offset = v
+		page = offset/perPage + 1
+	}
+
+	if offset > total {
+		offset = total
+	}
+	end := offset + perPage
+	if end > total {
+		end = total
+	}
+	if page > pages {
+		page = pages
+	}
+
+	return images[offset:end], GalleryInfo{Index: page, IndexMax: pages, Pages: pages, Total: total}
+}
+
+// DetectFormat sniffs the MIME type of the file at path from its header
+// bytes, the same way net/http content-type detection works.
+func DetectFormat(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// ThumbnailURLs builds the `/thumb/:size/*filename` URL for every configured
+// preset, without generating anything - generation happens lazily on request.
+func ThumbnailURLs(filename string) map[string]string {
+	urls := make(map[string]string, len(CurrentConfig().Thumbnails))
+	for name := range CurrentConfig().Thumbnails {
+		urls[name] = fmt.Sprintf("/thumb/%s/%s", name, filename)
+	}
+	return urls
+}
+
+// ThumbnailRoute serves a single named thumbnail variant of a gallery image,
+// generating and caching it on first request.
+func ThumbnailRoute(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	size := params.ByName("size")
+	filename := strings.TrimPrefix(params.ByName("filename"), "/")
+
+	thumbName := GenerateThumbnail(filename, size)
+	if thumbName == "" {
+		http.Error(w, "invalid filename", http.StatusBadRequest)
+		return
+	}
+	http.ServeFile(w, r, thumbName)
+}
+
+const (
+	PreviewWidth  = 1200
+	PreviewHeight = 630
+
+	// PreviewMinImages/PreviewMaxImages bound how many of the newest images
+	// are composited into the OpenGraph preview grid.
+	PreviewMinImages = 4
+	PreviewMaxImages = 9
+)
+
+// PreviewRoute serves a composited OpenGraph/Twitter share-preview image: a
+// grid of the newest PreviewMinImages..PreviewMaxImages thumbnails, cached
+// to disk and regenerated whenever a newer image is added to the gallery.
+func PreviewRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	images, err := loadImages()
+	if err != nil {
+		templates.WriteInternalError(w, err.Error())
+		return
+	}
+	if len(images) < PreviewMinImages {
+		http.NotFound(w, r)
+		return
+	}
+
+	sortImages(images, "mtime", true) // newest first
+	count := PreviewMaxImages
+	if len(images) < count {
+		count = len(images)
+	}
+	newest := images[:count]
+
+	previewPath := filepath.Join("public", CacheDirectory, "preview.jpg")
+
+	// Serialize regeneration so two concurrent requests for a stale preview
+	// can't both os.Create the same path at once.
+	unlock := lockCacheFile(previewPath)
+	defer unlock()
+
+	if cachedInfo, err := os.Stat(previewPath); err == nil && cachedInfo.Size() > 0 && !cachedInfo.ModTime().Before(newest[0].ModTime) {
+		http.ServeFile(w, r, previewPath)
+		return
+	}
+
+	canvas, err := compositePreviewGrid(newest)
+	if err != nil {
+		templates.WriteInternalError(w, err.Error())
+		return
+	}
+
+	// Generate into a temp file and rename it into place only once it's
+	// complete, so an encode failure partway through can't leave a
+	// truncated file sitting at previewPath (the same fix applied to
+	// GenerateThumbnail).
+	tmpFile, err := ioutil.TempFile(filepath.Join("public", CacheDirectory), "tmp-")
+	if err != nil {
+		templates.WriteInternalError(w, err.Error())
+		return
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // no-op once the rename below has succeeded
+
+	encodeErr := jpeg.Encode(tmpFile, canvas, &jpeg.Options{CurrentConfig().ThumbnailQuality})
+	tmpFile.Close()
+	if encodeErr != nil {
+		templates.WriteInternalError(w, encodeErr.Error())
+		return
+	}
+
+	if err := os.Rename(tmpName, previewPath); err != nil {
+		templates.WriteInternalError(w, err.Error())
+		return
+	}
+
+	http.ServeFile(w, r, previewPath)
+}
+
+// compositePreviewGrid draws the "l" thumbnail of each image into an evenly
+// spaced grid on a PreviewWidth x PreviewHeight canvas.
+func compositePreviewGrid(images []Image) (image.Image, error) {
+	canvas := image.NewRGBA(image.Rect(0, 0, PreviewWidth, PreviewHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	cols, rows := gridDimensions(len(images))
+	cellWidth, cellHeight := PreviewWidth/cols, PreviewHeight/rows
+
+	for i, img := range images {
+		thumbPath := GenerateThumbnail(img.Name, "l")
+
+		thumbFile, err := os.Open(thumbPath)
+		if err != nil {
+			log.Println("Warning: could not add", img.Name, "to preview:", err)
+			continue
+		}
+		cell, _, err := image.Decode(thumbFile)
+		thumbFile.Close()
 		if err != nil {
-			log.Println("Warning: could not create thumbnail for", filename, err)
-			return filepath.Join("public", GalleryDirectory, filename)
+			log.Println("Warning: could not add", img.Name, "to preview:", err)
+			continue
 		}
 
-		// Resize and save
-		thumb := resize.Thumbnail(config.ThumbnailWidth, config.ThumbnailHeight, img, resize.Lanczos2)
+		cell = resize.Thumbnail(uint(cellWidth), uint(cellHeight), cell, resize.Lanczos3)
+
+		col, row := i%cols, i/cols
+		origin := image.Pt(
+			col*cellWidth+(cellWidth-cell.Bounds().Dx())/2,
+			row*cellHeight+(cellHeight-cell.Bounds().Dy())/2,
+		)
+		draw.Draw(canvas, cell.Bounds().Add(origin), cell, image.Point{}, draw.Over)
+	}
+
+	return canvas, nil
+}
+
+// gridDimensions picks a near-square grid with enough cells for n images.
+func gridDimensions(n int) (cols, rows int) {
+	cols = int(math.Ceil(math.Sqrt(float64(n))))
+	if cols < 1 {
+		cols = 1
+	}
+	rows = int(math.Ceil(float64(n) / float64(cols)))
+	return cols, rows
+}
+
+// CacheStats holds running counters for the thumbnail cache, surfaced at
+// /debug/cache. Entries/Bytes are refreshed by the pruner; Hits/Misses are
+// updated on every GenerateThumbnail call that reaches the cache lookup.
+type CacheStats struct {
+	Entries int64
+	Bytes   int64
+	Hits    int64
+	Misses  int64
+}
+
+var cacheStats CacheStats
+
+// cacheFileLocks serializes writes to a given cache file path, so two
+// goroutines racing to build the same one (e.g. the gallery watcher's worker
+// pool handling the CREATE+WRITE event pair fsnotify emits for one upload, or
+// two concurrent requests for a not-yet-cached preview) can't both
+// os.Create/rename the same path at once.
+var cacheFileLocks sync.Map // map[string]*sync.Mutex
 
-		thumbFile, err := os.Create(thumbName)
+func lockCacheFile(path string) func() {
+	value, _ := cacheFileLocks.LoadOrStore(path, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// hashFileContents returns the hex-encoded SHA-256 of the file at path.
+func hashFileContents(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isSafeGalleryFilename reports whether filename is a bare file name with no
+// path separators or ".."/"." components, so joining it onto GalleryDirectory
+// can't escape it (e.g. via a `/thumb/:size/*filename` request for
+// "../../etc/passwd").
+func isSafeGalleryFilename(filename string) bool {
+	if filename == "" || filename == "." || filename == ".." {
+		return false
+	}
+	return filepath.Base(filepath.Clean(filename)) == filename
+}
+
+// GenerateThumbnail returns the path to the cached thumbnail for filename
+// under the named preset, generating it first if it doesn't exist yet. The
+// cache key is content-addressed: it includes a SHA-256 of the source file,
+// so edited source images automatically get a fresh thumbnail. If the
+// preset is unknown, or generation fails, the original image is served
+// instead. Animated GIF sources are kept animated unless disabled via the
+// `animated_thumbnails` config toggle, in which case only the first frame is
+// rendered as a still JPEG. Returns "" if filename isn't a safe bare file
+// name - the caller must check for that before treating the result as a
+// path to serve.
+func GenerateThumbnail(filename, presetName string) string {
+	if !isSafeGalleryFilename(filename) {
+		log.Println("Warning: rejected thumbnail request for unsafe filename:", filename)
+		return ""
+	}
+
+	original := filepath.Join("public", GalleryDirectory, filename)
+
+	preset, ok := CurrentConfig().Thumbnails[presetName]
+	if !ok {
+		log.Println("Warning: unknown thumbnail preset:", presetName)
+		return original
+	}
+
+	sourceInfo, err := os.Stat(original)
+	if err != nil {
+		log.Println("Warning: could not create thumbnail for", filename, err)
+		return original
+	}
+
+	hash, err := hashFileContents(original)
+	if err != nil {
+		log.Println("Warning: could not create thumbnail for", filename, err)
+		return original
+	}
+
+	format, err := DetectFormat(original)
+	if err != nil {
+		log.Println("Warning: could not create thumbnail for", filename, err)
+		return original
+	}
+	animated := format == "image/gif" && CurrentConfig().AnimatedThumbnails
+
+	ext := "jpg"
+	if animated {
+		ext = "gif"
+	}
+	thumbName := filepath.Join("public", CacheDirectory, fmt.Sprintf(
+		"%s-%s-%s-%dx%d.%s", presetName, filename, hash[:cacheHashLength], preset.Width, preset.Height, ext,
+	))
+
+	unlock := lockCacheFile(thumbName)
+	defer unlock()
+
+	// Skip regeneration if the cache entry is already at least as new as the
+	// source - the content hash in the name means a changed source always
+	// lands on a different filename anyway, but this avoids pointless
+	// rewrites of a fresh entry. A zero-byte entry is never treated as a hit
+	// so a thumbnail that failed to generate gets retried instead of being
+	// served (or pruned) as if it were valid forever.
+	if cachedInfo, err := os.Stat(thumbName); err == nil && cachedInfo.Size() > 0 && !cachedInfo.ModTime().Before(sourceInfo.ModTime()) {
+		atomic.AddInt64(&cacheStats.Hits, 1)
+		return thumbName
+	}
+	atomic.AddInt64(&cacheStats.Misses, 1)
+
+	file, err := os.Open(original)
+	if err != nil {
+		log.Println("Warning: could not create thumbnail for", filename, err)
+		return original
+	}
+	defer file.Close()
+
+	// Generate into a temp file and rename it into place only once it's
+	// complete, so a decode/encode failure partway through (e.g. a gallery
+	// file whose format isn't registered - only image/jpeg and image/gif are
+	// imported here) can never leave a truncated file sitting at thumbName.
+	tmpFile, err := ioutil.TempFile(filepath.Join("public", CacheDirectory), "tmp-")
+	if err != nil {
+		log.Println("Warning: could not create thumbnail for", filename, err)
+		return original
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName) // no-op once the rename below has succeeded
+
+	thumbnailer := Thumbnailer{Algorithm: preset.Algorithm}
+
+	if animated {
+		err := generateAnimatedThumbnail(file, tmpFile, thumbnailer, preset)
+		tmpFile.Close()
 		if err != nil {
-			log.Println("Warning: could not create thumbnail for", filename, err)
-			return filepath.Join("public", GalleryDirectory, filename)
+			log.Println("Warning: could not create animated thumbnail for", filename, err)
+			return original
 		}
-		jpeg.Encode(thumbFile, thumb, &jpeg.Options{config.ThumbnailQuality})
-		thumbFile.Close()
+	} else {
+		// Load original file (first frame only, for GIF sources)
+		img, _, decodeErr := image.Decode(file)
+		if decodeErr != nil {
+			tmpFile.Close()
+			log.Println("Warning: could not create thumbnail for", filename, decodeErr)
+			return original
+		}
+
+		// Resize (or crop) and save
+		thumb := thumbnailer.Scale(img, preset.Width, preset.Height, preset.Crop)
+		encodeErr := jpeg.Encode(tmpFile, thumb, &jpeg.Options{CurrentConfig().ThumbnailQuality})
+		tmpFile.Close()
+		if encodeErr != nil {
+			log.Println("Warning: could not create thumbnail for", filename, encodeErr)
+			return original
+		}
+	}
+
+	if err := os.Rename(tmpName, thumbName); err != nil {
+		log.Println("Warning: could not create thumbnail for", filename, err)
+		return original
 	}
 
 	return thumbName
 }
 
+// pruneCache walks the thumbnail cache directory, deleting any entry whose
+// source image no longer exists or whose content has since changed (i.e.
+// its current hash no longer matches the one baked into the filename), and
+// refreshes the entry/byte counts in cacheStats.
+func pruneCache() {
+	dir := filepath.Join("public", CacheDirectory)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Warning: could not list cache directory:", err)
+		}
+		return
+	}
+
+	var count, size int64
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := cacheFilenamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		// A zero-byte entry never finished generating (e.g. GenerateThumbnail
+		// failed partway through before the temp-file rename fix existed).
+		// Its hash still matches an unchanged source, so without this check
+		// it would never get evicted and would keep being served as a
+		// permanent "hit".
+		if entry.Size() == 0 {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+
+		originalName, hash := match[2], match[3]
+
+		sourcePath := filepath.Join("public", GalleryDirectory, originalName)
+		currentHash, err := hashFileContents(sourcePath)
+		if err != nil || currentHash[:cacheHashLength] != hash {
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+
+		count++
+		size += entry.Size()
+	}
+
+	atomic.StoreInt64(&cacheStats.Entries, count)
+	atomic.StoreInt64(&cacheStats.Bytes, size)
+}
+
+// runCachePruner runs pruneCache once immediately, then again every
+// interval. An interval <= 0 disables the periodic re-run.
+func runCachePruner(interval time.Duration) {
+	pruneCache()
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		pruneCache()
+	}
+}
+
+// CacheDebugRoute reports thumbnail cache stats as JSON. Gated behind
+// EnableDebugging since it exposes server filesystem details.
+func CacheDebugRoute(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !CurrentConfig().EnableDebugging {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries int64 `json:"entries"`
+		Bytes   int64 `json:"bytes"`
+		Hits    int64 `json:"hits"`
+		Misses  int64 `json:"misses"`
+	}{
+		Entries: atomic.LoadInt64(&cacheStats.Entries),
+		Bytes:   atomic.LoadInt64(&cacheStats.Bytes),
+		Hits:    atomic.LoadInt64(&cacheStats.Hits),
+		Misses:  atomic.LoadInt64(&cacheStats.Misses),
+	})
+}
+
+// generateAnimatedThumbnail resizes every frame of an animated GIF read from
+// src, preserving per-frame delay, disposal method and loop count, and
+// writes the result to dst.
+func generateAnimatedThumbnail(src io.Reader, dst io.Writer, thumbnailer Thumbnailer, preset ThumbnailPreset) error {
+	g, err := gif.DecodeAll(src)
+	if err != nil {
+		return err
+	}
+
+	for i, frame := range g.Image {
+		resized := thumbnailer.Scale(frame, preset.Width, preset.Height, preset.Crop)
+
+		paletted := image.NewPaletted(resized.Bounds(), frame.Palette)
+		draw.Draw(paletted, paletted.Bounds(), resized, resized.Bounds().Min, draw.Src)
+		g.Image[i] = paletted
+	}
+
+	if len(g.Image) > 0 {
+		b := g.Image[0].Bounds()
+		g.Config.Width = b.Dx()
+		g.Config.Height = b.Dy()
+	}
+
+	return gif.EncodeAll(dst, g)
+}
+
+// Thumbnailer scales images using a single, pluggable interpolation
+// algorithm, either fitting the source within the target box or cropping it
+// to fill the box exactly.
+type Thumbnailer struct {
+	Algorithm resize.InterpolationFunction
+}
+
+// Scale resizes img to width x height. When crop is false the image is
+// scaled down to fit within the box, preserving aspect ratio (the result may
+// be smaller than width x height on one axis). When crop is true the image
+// is scaled to cover the box and center-cropped to it exactly.
+func (t Thumbnailer) Scale(img image.Image, width, height uint, crop bool) image.Image {
+	if !crop {
+		return resize.Thumbnail(width, height, img, t.Algorithm)
+	}
+	return t.cropToFill(img, width, height)
+}
+
+func (t Thumbnailer) cropToFill(img image.Image, width, height uint) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := uint(bounds.Dx()), uint(bounds.Dy())
+
+	// Scale so the image covers the target box on both axes, leaving one
+	// axis oversized, then crop the overflow from the center.
+	var scaleWidth, scaleHeight uint
+	if srcWidth*height > srcHeight*width {
+		scaleHeight = height
+	} else {
+		scaleWidth = width
+	}
+	scaled := resize.Resize(scaleWidth, scaleHeight, img, t.Algorithm)
+
+	b := scaled.Bounds()
+	origin := image.Pt(b.Min.X+(b.Dx()-int(width))/2, b.Min.Y+(b.Dy()-int(height))/2)
+
+	cropped := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	draw.Draw(cropped, cropped.Bounds(), scaled, origin, draw.Src)
+	return cropped
+}
+
+// LoadViews preloads the configured theme's templates. The "default" theme
+// (view/default.html) emits og:image/twitter:image tags pointing at
+// /api/v1/preview, so links pasted into chat apps render a gallery preview.
 func LoadViews() {
 	templates.Init(&templates.Config{
 		ProjectView: ViewDirectory,
 		Handler:     nil,
 	})
-	templates.PreloadTemplate(config.ThemeName + ".html")
+	templates.PreloadTemplate(CurrentConfig().ThemeName + ".html")
 	templates.PreloadTemplates()
 }
 
-func main() {
-	var err error
+// reloadConfig re-reads the config file, atomically swaps the new config in
+// and then reloads the HTML views. Each CurrentConfig() call returns either
+// the old or the new config in full, never a half-applied one; a request
+// that calls CurrentConfig() more than once can see both.
+func reloadConfig() {
+	cfg, err := ReadConfig(ConfigFilename)
+	if err != nil {
+		log.Println("Error: could not reload config:", err)
+		return
+	}
+	configValue.Store(cfg)
+	LoadViews()
+	log.Println("Notice: config reloaded")
+}
 
+func main() {
 	// Read config
-	config, err = ReadConfig(ConfigFilename)
+	cfg, err := ReadConfig(ConfigFilename)
 	if err != nil {
 		log.Fatal(err)
 	}
+	configValue.Store(cfg)
 
 	// Load HTML views
 	LoadViews()
 
-	// TODO: listen for "reload" signal
+	// Listen for "reload" signal
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			reloadConfig()
+		}
+	}()
+
+	// Prune stale thumbnails on startup and periodically thereafter
+	go runCachePruner(time.Duration(CurrentConfig().CacheExpiration) * time.Second)
+
+	// Watch the gallery directory so DefaultRoute can serve from an
+	// in-memory index instead of stat-ing it on every request
+	if CurrentConfig().WatchGallery {
+		if _, err := StartGalleryWatcher(CurrentConfig().ThumbnailWorkers); err != nil {
+			log.Println("Warning: could not start gallery watcher:", err)
+		}
+	}
 
 	// Register route
 	staticHandler := http.FileServer(http.Dir("./"))
 	router.GET("/public/*filepath", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		staticHandler.ServeHTTP(w, r)
 	})
+	router.GET("/thumb/:size/*filename", ThumbnailRoute)
+	router.GET("/debug/cache", CacheDebugRoute)
+	router.GET("/api/v1/images", ImagesAPIRoute)
+	router.GET("/api/v1/images/:name", ImageAPIRoute)
+	router.GET("/api/v1/preview", PreviewRoute)
 	router.GET("/", DefaultRoute)
 
 	log.Println("Notice: server started listening at port", Port, "...")
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// withConfig installs cfg as the active config for the duration of the test,
+// restoring whatever was active beforehand.
+func withConfig(t *testing.T, cfg *Config) {
+	t.Helper()
+	previous := configValue.Load()
+	configValue.Store(cfg)
+	t.Cleanup(func() {
+		if previous != nil {
+			configValue.Store(previous)
+		}
+	})
+}
+
+func testImages(n int) []Image {
+	images := make([]Image, n)
+	for i := range images {
+		images[i] = Image{
+			Name:    fmt.Sprintf("img%03d.jpg", i),
+			ModTime: time.Unix(int64(i), 0),
+			Size:    int64(i),
+		}
+	}
+	return images
+}
+
+func TestSortImagesByName(t *testing.T) {
+	images := []Image{{Name: "b"}, {Name: "a"}, {Name: "c"}}
+	sortImages(images, "name", false)
+	want := []string{"a", "b", "c"}
+	for i, name := range want {
+		if images[i].Name != name {
+			t.Fatalf("position %d: got %s, want %s", i, images[i].Name, name)
+		}
+	}
+}
+
+func TestSortImagesByModTimeReversed(t *testing.T) {
+	images := []Image{
+		{Name: "old", ModTime: time.Unix(1, 0)},
+		{Name: "new", ModTime: time.Unix(3, 0)},
+		{Name: "mid", ModTime: time.Unix(2, 0)},
+	}
+	sortImages(images, "mtime", true)
+	want := []string{"new", "mid", "old"}
+	for i, name := range want {
+		if images[i].Name != name {
+			t.Fatalf("position %d: got %s, want %s", i, images[i].Name, name)
+		}
+	}
+}
+
+func TestSortImagesBySize(t *testing.T) {
+	images := []Image{{Name: "big", Size: 300}, {Name: "small", Size: 10}, {Name: "mid", Size: 100}}
+	sortImages(images, "size", false)
+	want := []string{"small", "mid", "big"}
+	for i, name := range want {
+		if images[i].Name != name {
+			t.Fatalf("position %d: got %s, want %s", i, images[i].Name, name)
+		}
+	}
+}
+
+func TestSortImagesUnknownByFallsBackToName(t *testing.T) {
+	images := []Image{{Name: "b"}, {Name: "a"}}
+	sortImages(images, "bogus", false)
+	if images[0].Name != "a" || images[1].Name != "b" {
+		t.Fatalf("unknown sort key should fall back to name, got %v", images)
+	}
+}
+
+func TestSortImagesRandomKeepsAllEntries(t *testing.T) {
+	images := testImages(20)
+	sortImages(images, "random", false)
+	if len(images) != 20 {
+		t.Fatalf("random sort changed length: got %d", len(images))
+	}
+	seen := make(map[string]bool, len(images))
+	for _, img := range images {
+		seen[img.Name] = true
+	}
+	if len(seen) != 20 {
+		t.Fatalf("random sort lost or duplicated entries: %v", images)
+	}
+}
+
+func TestPaginateImagesDisabledReturnsAll(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: false, ImagesPerPage: 2, PaginatorThreshold: 1})
+	images := testImages(5)
+	got, info := paginateImages(images, httptest.NewRequest("GET", "/", nil))
+	if len(got) != 5 {
+		t.Fatalf("expected all 5 images when pagination disabled, got %d", len(got))
+	}
+	if info.Pages != 1 || info.Index != 1 || info.Total != 5 {
+		t.Fatalf("unexpected GalleryInfo: %+v", info)
+	}
+}
+
+func TestPaginateImagesBelowThreshold(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: true, ImagesPerPage: 2, PaginatorThreshold: 10})
+	images := testImages(5)
+	got, info := paginateImages(images, httptest.NewRequest("GET", "/", nil))
+	if len(got) != 5 || info.Pages != 1 {
+		t.Fatalf("images at/below threshold should not be paginated, got %d images, info %+v", len(got), info)
+	}
+}
+
+func TestPaginateImagesByPage(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: true, ImagesPerPage: 2, PaginatorThreshold: 0})
+	images := testImages(5) // 3 pages: [0,1] [2,3] [4]
+	got, info := paginateImages(images, httptest.NewRequest("GET", "/?page=2", nil))
+	if len(got) != 2 || got[0].Name != images[2].Name {
+		t.Fatalf("page 2 should start at index 2, got %+v", got)
+	}
+	if info.Index != 2 || info.Pages != 3 || info.Total != 5 {
+		t.Fatalf("unexpected GalleryInfo: %+v", info)
+	}
+}
+
+func TestPaginateImagesLastPagePartial(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: true, ImagesPerPage: 2, PaginatorThreshold: 0})
+	images := testImages(5)
+	got, _ := paginateImages(images, httptest.NewRequest("GET", "/?page=3", nil))
+	if len(got) != 1 || got[0].Name != images[4].Name {
+		t.Fatalf("last partial page should contain exactly the remainder, got %+v", got)
+	}
+}
+
+func TestPaginateImagesPageBeyondLastClamps(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: true, ImagesPerPage: 2, PaginatorThreshold: 0})
+	images := testImages(5)
+	got, info := paginateImages(images, httptest.NewRequest("GET", "/?page=99", nil))
+	if info.Index != info.Pages {
+		t.Fatalf("out-of-range page should clamp to the last page, got index %d of %d", info.Index, info.Pages)
+	}
+	if len(got) != 1 {
+		t.Fatalf("clamped page should still return the last page's images, got %d", len(got))
+	}
+}
+
+func TestPaginateImagesOffsetOverridesPage(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: true, ImagesPerPage: 2, PaginatorThreshold: 0})
+	images := testImages(5)
+	got, info := paginateImages(images, httptest.NewRequest("GET", "/?page=1&offset=3", nil))
+	if len(got) != 2 || got[0].Name != images[3].Name {
+		t.Fatalf("offset should win over page, got %+v", got)
+	}
+	if info.Index != 2 {
+		t.Fatalf("offset 3 with perPage 2 should compute to page 2, got %d", info.Index)
+	}
+}
+
+func TestPaginateImagesOffsetBeyondTotalClampsToEmpty(t *testing.T) {
+	withConfig(t, &Config{EnablePagination: true, ImagesPerPage: 2, PaginatorThreshold: 0})
+	images := testImages(5)
+	got, _ := paginateImages(images, httptest.NewRequest("GET", "/?offset=100", nil))
+	if len(got) != 0 {
+		t.Fatalf("offset beyond total should yield zero images, got %d", len(got))
+	}
+}
+
+func TestParseThumbnailPreset(t *testing.T) {
+	preset, err := parseThumbnailPreset("90x90,crop,lanczos")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if preset.Width != 90 || preset.Height != 90 || !preset.Crop {
+		t.Fatalf("unexpected preset: %+v", preset)
+	}
+
+	if _, err := parseThumbnailPreset("90x90,sideways,lanczos"); err == nil {
+		t.Fatal("expected an error for an unknown crop mode")
+	}
+	if _, err := parseThumbnailPreset("90x90,crop,made-up-algorithm"); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+	if _, err := parseThumbnailPreset("90,crop,lanczos"); err == nil {
+		t.Fatal("expected an error for malformed dimensions")
+	}
+}
+
+func TestCropToFillProducesExactDimensions(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	thumbnailer := Thumbnailer{Algorithm: resize.NearestNeighbor}
+	out := thumbnailer.cropToFill(src, 100, 100)
+	b := out.Bounds()
+	if b.Dx() != 100 || b.Dy() != 100 {
+		t.Fatalf("cropToFill should produce exactly the requested box, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+func TestIsSafeGalleryFilenameRejectsTraversal(t *testing.T) {
+	cases := map[string]bool{
+		"photo.jpg":        true,
+		"sub/photo.jpg":    false,
+		"../photo.jpg":     false,
+		"../../etc/passwd": false,
+		"..":               false,
+		".":                false,
+		"":                 false,
+	}
+	for name, want := range cases {
+		if got := isSafeGalleryFilename(name); got != want {
+			t.Errorf("isSafeGalleryFilename(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCacheFilenamePatternMatchesGeneratedNames(t *testing.T) {
+	name := fmt.Sprintf("%s-%s-%s-%dx%d.%s", "m", "photo.jpg", "0123456789abcdef", 160, 160, "jpg")
+	match := cacheFilenamePattern.FindStringSubmatch(name)
+	if match == nil {
+		t.Fatalf("pattern did not match generated cache filename %q", name)
+	}
+	if match[1] != "m" || match[2] != "photo.jpg" || match[3] != "0123456789abcdef" {
+		t.Fatalf("unexpected submatches: %v", match)
+	}
+}
+
+func TestPruneCacheRemovesStaleAndZeroByteEntries(t *testing.T) {
+	dir := t.TempDir()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	if err := os.MkdirAll(filepath.Join("public", GalleryDirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join("public", CacheDirectory), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join("public", GalleryDirectory, "photo.jpg")
+	if err := ioutil.WriteFile(source, []byte("source bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFileContents(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := filepath.Join("public", CacheDirectory, fmt.Sprintf("m-photo.jpg-%s-160x160.jpg", hash[:cacheHashLength]))
+	if err := ioutil.WriteFile(valid, []byte("thumb bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	zeroByte := filepath.Join("public", CacheDirectory, fmt.Sprintf("m-photo.jpg-%s-320x320.jpg", hash[:cacheHashLength]))
+	if err := ioutil.WriteFile(zeroByte, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join("public", CacheDirectory, "m-photo.jpg-deadbeefdeadbeef-90x90.jpg")
+	if err := ioutil.WriteFile(stale, []byte("stale bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pruneCache()
+
+	if _, err := os.Stat(valid); err != nil {
+		t.Fatalf("valid cache entry should survive pruning: %v", err)
+	}
+	if _, err := os.Stat(zeroByte); !os.IsNotExist(err) {
+		t.Fatalf("zero-byte cache entry should be pruned")
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale-hash cache entry should be pruned")
+	}
+	if got := atomic.LoadInt64(&cacheStats.Entries); got != 1 {
+		t.Fatalf("expected 1 surviving entry counted, got %d", got)
+	}
+}
+
+func TestGalleryWatcherUpsertEntryConcurrentNoLostUpdates(t *testing.T) {
+	gw := &GalleryWatcher{}
+	galleryIndex.Store([]GalleryEntry{})
+	t.Cleanup(func() { galleryIndex.Store([]GalleryEntry{}) })
+
+	const n = 50
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			gw.upsertEntry(GalleryEntry{Name: fmt.Sprintf("file%03d.jpg", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(currentGalleryIndex()); got != n {
+		t.Fatalf("expected %d indexed entries after concurrent upserts, got %d (lost updates)", n, got)
+	}
+}